@@ -0,0 +1,224 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+// Package contenthash indexes the files and folders micropacker packs
+// into an immutable radix tree keyed by cleaned absolute path, so that
+// two runs (or two packed images) can be compared by their digests
+// instead of their raw contents, and so an unchanged path can be
+// recognized and skipped without re-reading it from disk.
+package contenthash
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	iradix "github.com/hashicorp/go-immutable-radix/v2"
+)
+
+// Record is what a Tree stores for a single packed path.
+type Record struct {
+	// IsDir marks a directory record.
+	IsDir bool `json:"isDir"`
+	// Size and ModTime are the last observed os.FileInfo values for a
+	// regular file; a later run trusts ContentDigest without
+	// re-reading the file as long as both still match.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// ContentDigest is the sha256 of a regular file's bytes. Empty for
+	// directories and non-regular files (symlinks, devices, ...).
+	ContentDigest string `json:"contentDigest,omitempty"`
+	// HeaderDigest is the sha256 over the tar header attributes that
+	// define a path's identity independent of its content: mode, uid,
+	// gid, symlink target and xattrs.
+	HeaderDigest string `json:"headerDigest"`
+	// MerkleDigest is set only on a directory's no-trailing-slash
+	// record: a digest over its children's digests, sorted, so it is
+	// stable regardless of the order they were walked in.
+	MerkleDigest string `json:"merkleDigest,omitempty"`
+}
+
+// Tree is an immutable radix tree of Records keyed by cleaned absolute
+// path. Insert returns a new Tree sharing structure with the receiver,
+// so a Tree loaded from a previous run can keep being queried while the
+// current run builds up its replacement.
+type Tree struct {
+	radix *iradix.Tree[Record]
+}
+
+// New returns an empty Tree.
+func New() *Tree {
+	return &Tree{radix: iradix.New[Record]()}
+}
+
+// Insert returns a new Tree with path mapped to record.
+func (t *Tree) Insert(path string, record Record) *Tree {
+	radix, _, _ := t.radix.Insert([]byte(treeKey(path)), record)
+	return &Tree{radix: radix}
+}
+
+// Get looks up the record stored for path, if any.
+func (t *Tree) Get(path string) (Record, bool) {
+	return t.radix.Get([]byte(treeKey(path)))
+}
+
+// treeKey cleans path but keeps a trailing slash, so a directory's
+// "/dir/" record stays distinct from its "/dir" record.
+func treeKey(path string) string {
+	cleaned := filepath.Clean(path)
+	if strings.HasSuffix(path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// Len returns the number of paths indexed.
+func (t *Tree) Len() int {
+	return t.radix.Len()
+}
+
+// Walk visits every (path, record) pair in lexical key order, stopping
+// early if fn returns true.
+func (t *Tree) Walk(fn func(path string, record Record) bool) {
+	t.radix.Root().Walk(func(k []byte, v Record) bool {
+		return fn(string(k), v)
+	})
+}
+
+// HashContent returns the sha256 digest of r's bytes.
+func HashContent(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// HashHeaderAttrs digests the tar header attributes that determine a
+// packed path's identity independent of its content.
+func HashHeaderAttrs(mode int64, uid, gid int, linkname string, xattrs map[string]string) string {
+	h := sha256.New()
+	io.WriteString(h, filepath.Clean(linkname))
+	io.WriteString(h, "\x00")
+	io.WriteString(h, strconv.FormatInt(mode, 8))
+	io.WriteString(h, "\x00")
+	io.WriteString(h, strconv.Itoa(uid))
+	io.WriteString(h, "\x00")
+	io.WriteString(h, strconv.Itoa(gid))
+	io.WriteString(h, "\x00")
+	keys := make([]string, 0, len(xattrs))
+	for k := range xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		io.WriteString(h, k)
+		io.WriteString(h, "=")
+		io.WriteString(h, xattrs[k])
+		io.WriteString(h, "\x00")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// MerkleDigest combines a directory's children digests into one digest
+// that is stable regardless of the order the children were walked in.
+func MerkleDigest(childDigests []string) string {
+	sorted := append([]string(nil), childDigests...)
+	sort.Strings(sorted)
+	h := sha256.New()
+	for _, d := range sorted {
+		io.WriteString(h, d)
+		io.WriteString(h, "\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// indexFile is the on-disk name of a persisted Tree under a cache dir.
+const indexFile = "index.json"
+
+type indexEntry struct {
+	Path   string `json:"path"`
+	Record Record `json:"record"`
+}
+
+// Save persists tree's entries to dir/index.json, sorted by path so the
+// file itself is reproducible across runs with identical content.
+func Save(tree *Tree, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries := make([]indexEntry, 0, tree.Len())
+	tree.Walk(func(path string, record Record) bool {
+		entries = append(entries, indexEntry{Path: path, Record: record})
+		return false
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, indexFile), data, 0644)
+}
+
+// Load reads a Tree previously written by Save from dir, or returns an
+// empty Tree if dir has no cached index yet.
+func Load(dir string) (*Tree, error) {
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if os.IsNotExist(err) {
+		return New(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []indexEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	tree := New()
+	for _, entry := range entries {
+		tree = tree.Insert(entry.Path, entry.Record)
+	}
+	return tree, nil
+}
+
+// BlobPath returns where a regular file's content is stored in dir's
+// content-addressable blob store, keyed by its sha256 digest.
+func BlobPath(dir, digest string) string {
+	return filepath.Join(dir, "blobs", "sha256", digest)
+}
+
+// OpenBlob opens a previously stored blob for reading.
+func OpenBlob(dir, digest string) (*os.File, error) {
+	return os.Open(BlobPath(dir, digest))
+}
+
+// CreateTempBlob creates a temporary file under dir's blob store that
+// CommitBlob can later move into place once its digest is known.
+func CreateTempBlob(dir string) (*os.File, error) {
+	blobsDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(blobsDir, "tmp-*")
+}
+
+// CommitBlob moves a file created by CreateTempBlob into its final,
+// digest-addressed location. If that blob already exists (identical
+// content packed before, even under a different path), the temporary
+// file is discarded instead.
+func CommitBlob(dir, tmpPath, digest string) error {
+	dest := BlobPath(dir, digest)
+	if _, err := os.Stat(dest); err == nil {
+		return os.Remove(tmpPath)
+	}
+	return os.Rename(tmpPath, dest)
+}
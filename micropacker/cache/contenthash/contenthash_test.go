@@ -0,0 +1,24 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+package contenthash
+
+import "testing"
+
+func TestMerkleDigestIsOrderIndependent(t *testing.T) {
+	children := []string{"digest-a", "digest-b", "digest-c"}
+	reordered := []string{"digest-c", "digest-a", "digest-b"}
+
+	got := MerkleDigest(children)
+	want := MerkleDigest(reordered)
+	if got != want {
+		t.Errorf("MerkleDigest order dependence: %q (original order) != %q (reordered)", got, want)
+	}
+
+	different := MerkleDigest([]string{"digest-a", "digest-b", "digest-d"})
+	if got == different {
+		t.Errorf("MerkleDigest(%v) == MerkleDigest with a changed child, want distinct digests", children)
+	}
+}
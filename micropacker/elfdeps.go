@@ -0,0 +1,176 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// resolveAndAddELFDeps is called for every regular file addToSetsFromPath
+// adds. If normalizedPathString is an ET_EXEC/ET_DYN ELF binary, its
+// PT_DYNAMIC segment is parsed for DT_NEEDED entries, each of which is
+// resolved to a file on disk and fed back into addToSetsFromPath, so
+// transitive dependencies (libssl -> libcrypto -> libz) are captured
+// without the caller having to list every .so by hand. Non-ELF files and
+// statically linked binaries simply have nothing to resolve.
+func (container baseContainer) resolveAndAddELFDeps(normalizedPathString string) {
+	if !container.resolveLdDeps {
+		return
+	}
+
+	elfFile, err := elf.Open(normalizedPathString)
+	if err != nil {
+		// not an ELF file (or unreadable) - nothing to resolve
+		return
+	}
+	defer elfFile.Close()
+
+	if elfFile.Type != elf.ET_EXEC && elfFile.Type != elf.ET_DYN {
+		return
+	}
+
+	needed, rpath, runpath := readDynamicDeps(elfFile)
+	searchDirs := elfSearchDirs(normalizedPathString, rpath, runpath)
+
+	for _, name := range needed {
+		libPath, ok := resolveLibrary(name, searchDirs)
+		if !ok {
+			if container.debugMode {
+				fmt.Printf("[resolveAndAddELFDeps]: couldn't resolve %s needed by %s\n", name, normalizedPathString)
+			}
+			continue
+		}
+		if container.fileSet[libPath] {
+			// already added (and thus already resolved), skip to avoid
+			// re-walking a dependency cycle
+			continue
+		}
+		if container.debugMode {
+			fmt.Printf("[resolveAndAddELFDeps]: %s needs %s, resolved to %s\n", normalizedPathString, name, libPath)
+		}
+		container.addToSetsFromPath(libPath)
+	}
+}
+
+// readDynamicDeps returns elfFile's DT_NEEDED, DT_RPATH and DT_RUNPATH
+// entries. A statically linked binary has no dynamic segment, so all
+// three come back empty.
+func readDynamicDeps(elfFile *elf.File) (needed, rpath, runpath []string) {
+	needed, _ = elfFile.ImportedLibraries()
+	rpath, _ = elfFile.DynString(elf.DT_RPATH)
+	runpath, _ = elfFile.DynString(elf.DT_RUNPATH)
+	return
+}
+
+// elfSearchDirs returns the directories resolveLibrary should search, in
+// the same order the dynamic linker would: DT_RUNPATH (falling back to
+// DT_RPATH when no DT_RUNPATH is present, matching glibc), then
+// LD_LIBRARY_PATH, then /etc/ld.so.conf(.d), then the standard library
+// directories.
+func elfSearchDirs(binaryPath string, rpath, runpath []string) []string {
+	var dirs []string
+	if len(runpath) > 0 {
+		dirs = append(dirs, expandTokens(runpath, binaryPath)...)
+	} else {
+		dirs = append(dirs, expandTokens(rpath, binaryPath)...)
+	}
+	if ldLibraryPath, ok := os.LookupEnv("LD_LIBRARY_PATH"); ok {
+		dirs = append(dirs, strings.Split(ldLibraryPath, ":")...)
+	}
+	dirs = append(dirs, ldSoConfDirs()...)
+	dirs = append(dirs, "/lib", "/usr/lib", "/lib64", "/usr/lib64")
+	return dirs
+}
+
+// expandTokens splits a colon-separated RPATH/RUNPATH list and expands
+// the $ORIGIN, $LIB and $PLATFORM tokens (and their ${...} form) glibc
+// recognizes in them, relative to the directory of the binary that
+// referenced them.
+func expandTokens(entries []string, binaryPath string) []string {
+	origin := filepath.Dir(binaryPath)
+	lib := "lib64"
+	if runtime.GOARCH == "386" || runtime.GOARCH == "arm" {
+		lib = "lib"
+	}
+	replacer := strings.NewReplacer(
+		"$ORIGIN", origin, "${ORIGIN}", origin,
+		"$LIB", lib, "${LIB}", lib,
+		"$PLATFORM", runtime.GOARCH, "${PLATFORM}", runtime.GOARCH,
+	)
+
+	var expanded []string
+	for _, entry := range entries {
+		for _, dir := range strings.Split(entry, ":") {
+			if dir == "" {
+				continue
+			}
+			expanded = append(expanded, replacer.Replace(dir))
+		}
+	}
+	return expanded
+}
+
+// resolveLibrary searches dirs in order for a regular file named name,
+// returning its path and true the first time it's found.
+func resolveLibrary(name string, dirs []string) (string, bool) {
+	for _, dir := range dirs {
+		candidate := filepath.Join(dir, name)
+		if fileInfo, err := os.Lstat(candidate); err == nil && !fileInfo.IsDir() {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// ldSoConfDirs parses /etc/ld.so.conf and whatever ld.so.conf.d/*.conf
+// files it includes, returning the library directories they list. This
+// is best-effort: a missing or unreadable config file is silently
+// skipped, same as a container image that simply has no ldconfig setup.
+func ldSoConfDirs() []string {
+	var dirs []string
+	seen := map[string]bool{"/etc/ld.so.conf": true}
+
+	var readConfFile func(confPath string)
+	readConfFile = func(confPath string) {
+		file, err := os.Open(confPath)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if strings.HasPrefix(line, "include ") {
+				pattern := strings.TrimSpace(line[len("include "):])
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(confPath), pattern)
+				}
+				matches, _ := filepath.Glob(pattern)
+				for _, match := range matches {
+					if !seen[match] {
+						seen[match] = true
+						readConfFile(match)
+					}
+				}
+				continue
+			}
+			dirs = append(dirs, line)
+		}
+	}
+
+	readConfFile("/etc/ld.so.conf")
+	return dirs
+}
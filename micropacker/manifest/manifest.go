@@ -0,0 +1,110 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+// Package manifest implements micropacker's optional manifest-driven
+// packing mode: a YAML or TOML file that declares what to pack, instead
+// of the plain newline-delimited -i file.
+package manifest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Symlink is an explicit link -> target pair the manifest wants created
+// in the packed rootfs even when Link doesn't exist on the packing
+// host's filesystem.
+type Symlink struct {
+	Link   string `yaml:"link" toml:"link"`
+	Target string `yaml:"target" toml:"target"`
+}
+
+// Package is the metadata micropacker writes into a manifest-driven
+// pack's sidecar receipt.
+type Package struct {
+	Name    string `yaml:"name" toml:"name"`
+	Version string `yaml:"version" toml:"version"`
+	Arch    string `yaml:"arch" toml:"arch"`
+}
+
+// Manifest is the top-level shape of a -m manifest file.
+type Manifest struct {
+	// Files are globs resolved and fed through the same
+	// addToSetsFromPath logic as -i lines.
+	Files []string `yaml:"files" toml:"files"`
+	// Ignore overrides the hardcoded ignorePaths normally used while
+	// scanning (/dev, /proc, /sys, /var/lib/docker).
+	Ignore []string `yaml:"ignore" toml:"ignore"`
+	// Symlinks are created in the output even if Link doesn't exist on
+	// the packing host.
+	Symlinks []Symlink `yaml:"symlinks" toml:"symlinks"`
+	// PreInstall and PostInstall are shell commands written out as
+	// scripts at well-known paths in the packed rootfs.
+	PreInstall  []string `yaml:"pre_install" toml:"pre_install"`
+	PostInstall []string `yaml:"post_install" toml:"post_install"`
+	Package     Package  `yaml:"package" toml:"package"`
+}
+
+// PreInstallPath and PostInstallPath are the well-known locations
+// pre_install/post_install scripts are written to in the packed rootfs.
+const (
+	PreInstallPath  = "/.micropacker/pre-install.sh"
+	PostInstallPath = "/.micropacker/post-install.sh"
+)
+
+// Load reads and parses a manifest file, choosing YAML or TOML based on
+// its extension (.yaml/.yml or .toml).
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, m); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, m); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("[manifest]: unsupported manifest extension " + ext + ", expected .yaml, .yml or .toml")
+	}
+	return m, nil
+}
+
+// ResolveFiles expands every glob in m.Files against the local
+// filesystem, returning the matched paths.
+func (m *Manifest) ResolveFiles() ([]string, error) {
+	var resolved []string
+	for _, pattern := range m.Files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if matches == nil {
+			return nil, errors.New("[manifest]: files pattern matched nothing: " + pattern)
+		}
+		resolved = append(resolved, matches...)
+	}
+	return resolved, nil
+}
+
+// InstallScript renders commands as a "#!/bin/sh" script, or returns
+// nil if there are no commands to run.
+func InstallScript(commands []string) []byte {
+	if len(commands) == 0 {
+		return nil
+	}
+	script := "#!/bin/sh\nset -e\n" + strings.Join(commands, "\n") + "\n"
+	return []byte(script)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+package manifest
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ReceiptEntry is one path micropacker packed for a manifest-driven
+// build, recorded so a later -uninstall can find it again.
+type ReceiptEntry struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256,omitempty"` // empty for directories and symlinks
+}
+
+// Receipt is the sidecar JSON written next to a manifest-driven pack's
+// output; it doubles as the uninstall manifest.
+type Receipt struct {
+	Package Package        `json:"package"`
+	Paths   []ReceiptEntry `json:"paths"`
+}
+
+// WriteReceipt writes receipt to path as indented JSON.
+func WriteReceipt(receipt *Receipt, path string) error {
+	data, err := json.MarshalIndent(receipt, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// LoadReceipt reads a receipt previously written by WriteReceipt.
+func LoadReceipt(path string) (*Receipt, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	receipt := &Receipt{}
+	if err := json.Unmarshal(data, receipt); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// Uninstall removes receipt's paths from under root, skipping any path
+// still listed by one of the otherReceipts (so a shared dependency
+// installed by two packages isn't removed while either still claims
+// it). Paths are removed deepest-first so a directory is only removed
+// once everything under it is already gone; a non-empty directory left
+// behind (because it holds something not in the receipt) is left in
+// place rather than forced away. Returns the paths actually removed.
+func Uninstall(receipt *Receipt, otherReceipts []*Receipt, root string) ([]string, error) {
+	stillReferenced := make(map[string]bool)
+	for _, other := range otherReceipts {
+		for _, entry := range other.Paths {
+			stillReferenced[entry.Path] = true
+		}
+	}
+
+	paths := make([]string, 0, len(receipt.Paths))
+	for _, entry := range receipt.Paths {
+		paths = append(paths, entry.Path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Count(paths[i], "/") > strings.Count(paths[j], "/")
+	})
+
+	cleanRoot := filepath.Clean(root)
+	var removed []string
+	for _, path := range paths {
+		if stillReferenced[path] {
+			continue
+		}
+		target, ok := safeJoin(cleanRoot, path)
+		if !ok {
+			// a receipt entry that escapes root (e.g. via "../") is
+			// never legitimate - the receipt being uninstalled may not
+			// have been written by this process, so treat it the same
+			// as "nothing to remove" rather than following it outside root.
+			continue
+		}
+		if err := os.Remove(target); err != nil {
+			if os.IsNotExist(err) || isDirNotEmpty(err) {
+				continue
+			}
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// safeJoin joins path onto cleanRoot (already filepath.Clean'd) and
+// reports whether the result still lands inside cleanRoot, rejecting a
+// path like "/../outside/victim.txt" that would otherwise resolve
+// outside it.
+func safeJoin(cleanRoot, path string) (string, bool) {
+	target := filepath.Join(cleanRoot, path)
+	rel, err := filepath.Rel(cleanRoot, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return target, true
+}
+
+// isDirNotEmpty reports whether err comes from os.Remove refusing to
+// remove a non-empty directory, which Uninstall treats as "still in
+// use" rather than a failure.
+func isDirNotEmpty(err error) bool {
+	return strings.Contains(err.Error(), "directory not empty")
+}
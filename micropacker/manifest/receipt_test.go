@@ -0,0 +1,59 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+package manifest
+
+import "testing"
+
+func TestSafeJoinRejectsEscapingPaths(t *testing.T) {
+	cleanRoot := "/sandbox"
+
+	escaping := []string{
+		"/../outside/victim.txt",
+		"../../outside/victim.txt",
+		"..",
+	}
+	for _, path := range escaping {
+		if _, ok := safeJoin(cleanRoot, path); ok {
+			t.Errorf("safeJoin(%q, %q) = ok, want rejected", cleanRoot, path)
+		}
+	}
+
+	inBounds := []string{
+		"file.txt",
+		"/file.txt",
+		"sub/dir/file.txt",
+		"/sub/../file.txt",
+	}
+	for _, path := range inBounds {
+		target, ok := safeJoin(cleanRoot, path)
+		if !ok {
+			t.Errorf("safeJoin(%q, %q) = rejected, want ok", cleanRoot, path)
+			continue
+		}
+		wantPrefix := cleanRoot + "/"
+		if len(target) < len(wantPrefix) || target[:len(wantPrefix)] != wantPrefix {
+			t.Errorf("safeJoin(%q, %q) = %q, want under %q", cleanRoot, path, target, cleanRoot)
+		}
+	}
+}
+
+func TestUninstallSkipsPathsEscapingRoot(t *testing.T) {
+	root := t.TempDir()
+
+	receipt := &Receipt{
+		Paths: []ReceiptEntry{
+			{Path: "/../outside/victim.txt"},
+		},
+	}
+
+	removed, err := Uninstall(receipt, nil, root)
+	if err != nil {
+		t.Fatalf("Uninstall: %v", err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("Uninstall removed %v, want nothing removed for an escaping receipt entry", removed)
+	}
+}
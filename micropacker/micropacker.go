@@ -12,14 +12,24 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+
+	"github.com/vmware-archive/micropacker-for-containers/cache/contenthash"
+	"github.com/vmware-archive/micropacker-for-containers/manifest"
 )
 
+// defaultIgnorePaths are the hardcoded paths addToSetsFromPath skips
+// unless unsafePaths is set or a manifest's ignore: list overrides them.
+var defaultIgnorePaths = []string{"/dev", "/proc", "/sys", "/var/lib/docker"}
+
 // OOP stub
 type baseContainer struct {
 	pathEnvVar      string
 	unsafePaths     bool
 	debugMode       bool
+	resolveLdDeps   bool
+	ignorePaths     []string
 	fileSet         map[string]bool
 	folderSet       map[string]bool
 	neededFolderSet map[string]bool
@@ -48,8 +58,9 @@ func (container baseContainer) lookEnvForFile(file string) (string, bool) {
 
 func (container baseContainer) addToSetsFromPath(pathString string) {
 
-	// hardcoded paths to ignore
-	ignorePaths := []string{"/dev", "/proc", "/sys", "/var/lib/docker"}
+	// container.ignorePaths defaults to defaultIgnorePaths, but a
+	// manifest's ignore: list can override it
+	ignorePaths := container.ignorePaths
 	// if the user has decided to enable unsafe archiving, disable all ignorePaths
 	if container.unsafePaths {
 		ignorePaths = []string{}
@@ -121,6 +132,7 @@ func (container baseContainer) addToSetsFromPath(pathString string) {
 			fmt.Printf("[addToSetsFromPath]: adding %s\n", normalizedPathString)
 		}
 		container.fileSet[normalizedPathString] = true
+		container.resolveAndAddELFDeps(normalizedPathString)
 	} else {
 		// we shouldn't end here
 		fmt.Fprintln(os.Stderr, err)
@@ -185,13 +197,16 @@ func (container baseContainer) finalize() []string {
 		allPaths[i] = key
 		i++
 	}
+	// sort lexicographically so the tar/image output has a stable,
+	// reproducible entry order regardless of map iteration order
+	sort.Strings(allPaths)
 	return allPaths
 }
 
 
 // OOP constructor stub
-func newBaseContainer(pathEnvVar string, unsafePaths bool, debugMode bool) baseContainer {
-	return baseContainer{pathEnvVar, unsafePaths, debugMode, make(map[string]bool), make(map[string]bool), make(map[string]bool)}
+func newBaseContainer(pathEnvVar string, unsafePaths bool, debugMode bool, resolveLdDeps bool) baseContainer {
+	return baseContainer{pathEnvVar, unsafePaths, debugMode, resolveLdDeps, defaultIgnorePaths, make(map[string]bool), make(map[string]bool), make(map[string]bool)}
 }
 
 // main
@@ -209,12 +224,51 @@ func main() {
 	unsafeFlag := flag.Bool("u", false, "unsafe archiving, disable hardcoded checks")
 	debugFlag := flag.Bool("d", false, "debug mode (verbose output)")
 	packageFlag := flag.String("p", "", "gather package information with detected pkg managers")
+	formatFlag := flag.String("f", "tar", "output format: tar (raw rootfs tar), oci (OCI image layout) or docker (docker load-compatible image)")
+	entrypointFlag := flag.String("entrypoint", "", "entrypoint recorded in the image config for -f oci/docker (defaults to the basename of -x)")
+	compressFlag := flag.String("c", "none", "compression for the packed layer: gzip, zstd or none")
+	uidFlag := flag.Int("uid", 0, "uid every packed file is normalized to, for reproducible output")
+	gidFlag := flag.Int("gid", 0, "gid every packed file is normalized to, for reproducible output")
+	sourceDateEpochFlag := flag.Int64("source-date-epoch", 0, "unix timestamp every packed file's mtime is pinned to, for reproducible output")
+	cacheFlag := flag.String("cache", "", "directory to persist a content hash cache in, so unchanged files are skipped on the next run")
+	manifestFlag := flag.String("m", "", "YAML/TOML manifest to pack from, as an alternative to -i")
+	receiptFlag := flag.String("receipt", "", "sidecar receipt JSON path for a manifest-driven pack (default: <output>.receipt.json)")
+	uninstallFlag := flag.String("uninstall", "", "uninstall a manifest-driven package using the given receipt JSON, instead of packing")
+	rootFlag := flag.String("root", "/", "target root -uninstall removes paths from")
+	receiptsDirFlag := flag.String("receipts-dir", "", "directory of other receipts to check before removing a path still referenced elsewhere, used with -uninstall")
+	noLdResolveFlag := flag.Bool("noldresolve", false, "disable automatic resolution of ELF shared-library dependencies via DT_NEEDED")
+	pkgFormatFlag := flag.String("pf", "text", "package info output format when -p is set: text or json")
 	flag.Parse()
 
+	if *uninstallFlag != "" {
+		runUninstall(*uninstallFlag, *rootFlag, *receiptsDirFlag, *debugFlag)
+		return
+	}
+
+	if *formatFlag != "tar" && *formatFlag != "oci" && *formatFlag != "docker" {
+		fmt.Fprintf(os.Stderr, "unknown -f format %q, expected tar, oci or docker\n", *formatFlag)
+		return
+	}
+	if *compressFlag != "none" && *compressFlag != "gzip" && *compressFlag != "zstd" {
+		fmt.Fprintf(os.Stderr, "unknown -c compression %q, expected gzip, zstd or none\n", *compressFlag)
+		return
+	}
+	if *pkgFormatFlag != "text" && *pkgFormatFlag != "json" {
+		fmt.Fprintf(os.Stderr, "unknown -pf format %q, expected text or json\n", *pkgFormatFlag)
+		return
+	}
+	tarOpts := tarOptions{uid: *uidFlag, gid: *gidFlag, sourceDateEpoch: *sourceDateEpochFlag}
+
 	// check that string flags are set correctly, do not allow for empty "" strings
 	// but do not check for packageFlag (an empty one means disable)
-	if *inputFlag == "" {
-		fmt.Fprintln(os.Stderr, "input file cannot be empty")
+	if *inputFlag == "" && *manifestFlag == "" {
+		fmt.Fprintln(os.Stderr, "either -i or -m must be set")
+		fmt.Printf("Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		return
+	}
+	if *inputFlag != "" && *manifestFlag != "" {
+		fmt.Fprintln(os.Stderr, "-i and -m are mutually exclusive")
 		fmt.Printf("Usage of %s:\n", os.Args[0])
 		flag.PrintDefaults()
 		return
@@ -264,134 +318,264 @@ func main() {
 	}
 
 	// create a container - OOP skeleton
-	container := newBaseContainer(pathEnvVar, *unsafeFlag, *debugFlag)
+	container := newBaseContainer(pathEnvVar, *unsafeFlag, *debugFlag, !*noLdResolveFlag)
 
 	// add the file read from interp section
 	// independently of the list of files specified in input, this is fixed
 	container.addToSetsFromPath(interp)
 
-	// read the input file
-	inputFile, err := os.Open(*inputFlag)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
-	}
-	defer inputFile.Close()
-
-	scanner := bufio.NewScanner(inputFile)
-	for scanner.Scan() {
-		// pathString contains the input line
-		pathString := scanner.Text()
-		// check if pathString is not pointing to an existing file or folder
-		if _, err := os.Lstat(pathString); err != nil {
-			if os.IsNotExist(err) && !path.IsAbs(pathString) {
-				// if not an abs path, we might have something relative (i.e. a "java" string)
-				// try to figure out if "java" is a command looking into the environment
-				foundPath, ok := container.lookEnvForFile(pathString)
-				if ok {
-					container.addToSetsFromPath(foundPath)
+	var loadedManifest *manifest.Manifest
+	var synthetic []syntheticEntry
+
+	if *manifestFlag != "" {
+		loadedManifest, err = manifest.Load(*manifestFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		if len(loadedManifest.Ignore) > 0 {
+			container.ignorePaths = loadedManifest.Ignore
+		}
+		resolvedFiles, err := loadedManifest.ResolveFiles()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		for _, resolvedFile := range resolvedFiles {
+			container.addToSetsFromPath(resolvedFile)
+		}
+		for _, symlink := range loadedManifest.Symlinks {
+			synthetic = append(synthetic, syntheticEntry{name: symlink.Link, linkname: symlink.Target, mode: 0777})
+		}
+		if script := manifest.InstallScript(loadedManifest.PreInstall); script != nil {
+			synthetic = append(synthetic, syntheticEntry{name: manifest.PreInstallPath, content: script, mode: 0755})
+		}
+		if script := manifest.InstallScript(loadedManifest.PostInstall); script != nil {
+			synthetic = append(synthetic, syntheticEntry{name: manifest.PostInstallPath, content: script, mode: 0755})
+		}
+	} else {
+		// read the input file
+		inputFile, err := os.Open(*inputFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		defer inputFile.Close()
+
+		scanner := bufio.NewScanner(inputFile)
+		for scanner.Scan() {
+			// pathString contains the input line
+			pathString := scanner.Text()
+			// check if pathString is not pointing to an existing file or folder
+			if _, err := os.Lstat(pathString); err != nil {
+				if os.IsNotExist(err) && !path.IsAbs(pathString) {
+					// if not an abs path, we might have something relative (i.e. a "java" string)
+					// try to figure out if "java" is a command looking into the environment
+					foundPath, ok := container.lookEnvForFile(pathString)
+					if ok {
+						container.addToSetsFromPath(foundPath)
+					}
 				}
+				// other error in os.Lstat or this line is complete "garbage", discard
+				continue
+			} else {
+				// err is nil, pathString points to something, either file or folder
+				container.addToSetsFromPath(pathString)
 			}
-			// other error in os.Lstat or this line is complete "garbage", discard
-			continue
-		} else {
-			// err is nil, pathString points to something, either file or folder
-			container.addToSetsFromPath(pathString)
 		}
-	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
 	}
 
 	// before finalizing the container, perform pkg info gathering
 	// IMPORTANT! pkg info retrieval is done on files only, not on folders
 	if *packageFlag != "" {
-		pkgInfoFile, err := os.Create(*packageFlag)
-		defer pkgInfoFile.Close()
+		if err := gatherPackageInfo(container, *packageFlag, *pkgFormatFlag, *debugFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+
+	// now finalize the container and return a slice with all paths
+	// finalize will remove all duplicates and redundancies in
+	// container.fileSet and container.folderSet
+	allPaths := container.finalize()
+
+	// continue ...
+	if *debugFlag {
+		for _, v := range allPaths {
+			fmt.Printf("[main]: adding to tar %s\n", v)
+		}
+	}
+
+	// if -cache is set, load the content hash cache from the previous
+	// run so unchanged files can be streamed back out instead of
+	// re-read, and persist the updated cache once packing is done
+	var cache *packCache
+	if *cacheFlag != "" {
+		cache, err = openPackCache(*cacheFlag)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			return
 		}
-		// we need to detect what package managers are in this container
-		// for now, we will support only dpkg and rpm
-		pkgMngrFound := false
+	}
 
-		// dpkg support
-		pkgMngrPath, ok := container.lookEnvForFile("dpkg")
-		if ok {
-			pkgMngrFound = true
-			if *debugFlag {
-				fmt.Printf("[main]: dpkg package manager detected\n")
-			}
-			pkgInfoFile.WriteString("dpkg package manager results:\n")
-			for filePath, _ := range container.fileSet {
-				if *debugFlag {
-					fmt.Printf("[main]: executing %s -S %s\n", pkgMngrPath, filePath)
-				}
-				// the command we want to execute is "dpkg -S filePath"
-				output, err := ExecCmd(pkgMngrPath, "-S", filePath)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-					continue
-				}
-				pkgInfoFile.WriteString(output)
-			}
-			// pretty newline in case of multiple package managers inside a container
-			pkgInfoFile.WriteString("\n")
+	// create the tarfile (or image) specified in outputFlag
+	if *formatFlag == "tar" {
+		if err := WriteTar(*outputFlag, allPaths, *compressFlag, tarOpts, cache, synthetic); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
 		}
+	} else {
+		cfg := imageConfig{
+			interp:       *interpFlag,
+			entrypoint:   *entrypointFlag,
+			env:          []string{"PATH=" + pathEnvVar},
+			workingDir:   "/",
+			architecture: GetArchFromExec(*interpFlag),
+			os:           "linux",
+		}
+		if err := WriteImage(*outputFlag, allPaths, *formatFlag, *compressFlag, tarOpts, cache, synthetic, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
 
-		// the following rpm block is not in an "else" block
-		// if a container has multiple package managers, we will try to manage both
+	if cache != nil {
+		if err := cache.save(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
 
-		// rpm support
-		pkgMngrPath, ok = container.lookEnvForFile("rpm")
-		if ok {
-			pkgMngrFound = true
-			if *debugFlag {
-				fmt.Printf("[main]: rpm package manager detected\n")
+	if loadedManifest != nil {
+		receiptPath := *receiptFlag
+		if receiptPath == "" {
+			receiptPath = *outputFlag + ".receipt.json"
+		}
+		if err := writeManifestReceipt(loadedManifest, allPaths, synthetic, cache, receiptPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		if *debugFlag {
+			fmt.Printf("[main]: receipt written to %s\n", receiptPath)
+		}
+	}
+
+	if *debugFlag {
+		fmt.Printf("[main]: packing complete!\n")
+	}
+}
+
+// writeManifestReceipt records the sha256 of every packed path (empty
+// for directories/symlinks) and writes the sidecar receipt a later
+// -uninstall reads back. When cache is set, a path's digest is already
+// known from packing it (streamRegularFile/packCache computed it while
+// streaming into the layer) and is reused instead of re-reading the
+// file, so -m and -cache together keep the same near-zero-I/O re-run
+// behavior -cache alone provides.
+func writeManifestReceipt(m *manifest.Manifest, paths []string, synthetic []syntheticEntry, cache *packCache, receiptPath string) error {
+	entries := make([]manifest.ReceiptEntry, 0, len(paths)+len(synthetic))
+	for _, p := range paths {
+		// walk each path the same way addToTar does, so a packed
+		// directory's contents are listed too
+		err := filepath.Walk(p, func(walkedPath string, _ os.FileInfo, err error) error {
+			if err != nil {
+				return err
 			}
-			pkgInfoFile.WriteString("rpm package manager results:\n")
-			for filePath, _ := range container.fileSet {
-				if *debugFlag {
-					fmt.Printf("[main]: executing %s -qf %s\n", pkgMngrPath, filePath)
-				}
-				// the command we want to execute is "rpm -qf filePath"
-				output, err := ExecCmd(pkgMngrPath, "-qf", filePath)
-                                if err != nil {
-                                        fmt.Fprintln(os.Stderr, err)
-                                        continue
-                                }
-				// for rpm, add filePath info in output
-                                pkgInfoFile.WriteString(output + " " + filePath)
+			digest, err := hashPackedPath(walkedPath, cache)
+			if err != nil {
+				return err
 			}
-			// pretty printing
-			pkgInfoFile.WriteString("\n")
+			entries = append(entries, manifest.ReceiptEntry{Path: walkedPath, SHA256: digest})
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		// TODO add more package manager support
-		if !pkgMngrFound && *debugFlag {
-			fmt.Printf("[main]: warning! couldn't detect any known package manager\n")
+	}
+	for _, entry := range synthetic {
+		digest := ""
+		if entry.linkname == "" {
+			digest = sha256Hex(entry.content)
 		}
+		entries = append(entries, manifest.ReceiptEntry{Path: entry.name, SHA256: digest})
 	}
+	receipt := &manifest.Receipt{Package: m.Package, Paths: entries}
+	return manifest.WriteReceipt(receipt, receiptPath)
+}
 
-	// now finalize the container and return a slice with all paths
-	// finalize will remove all duplicates and redundancies in
-	// container.fileSet and container.folderSet
-	allPaths := container.finalize()
+// hashPackedPath returns the sha256 of path's content, or "" if path is
+// not a regular file (directories and symlinks carry no content hash).
+// If cache already holds a content digest for path from packing it this
+// run, that digest is reused instead of re-reading the file.
+func hashPackedPath(p string, cache *packCache) (string, error) {
+	fileInfo, err := os.Lstat(p)
+	if err != nil {
+		return "", err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return "", nil
+	}
+	if cache != nil {
+		if record, ok := cache.next.Get(p); ok && record.ContentDigest != "" {
+			return record.ContentDigest, nil
+		}
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return contenthash.HashContent(file)
+}
 
-	// continue ...
-	if *debugFlag {
-		for _, v := range allPaths {
-			fmt.Printf("[main]: adding to tar %s\n", v)
+// runUninstall removes receiptPath's packed paths from under root,
+// skipping any path still referenced by another receipt found in
+// receiptsDir.
+func runUninstall(receiptPath, root, receiptsDir string, debug bool) {
+	receipt, err := manifest.LoadReceipt(receiptPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	var others []*manifest.Receipt
+	if receiptsDir != "" {
+		entries, err := os.ReadDir(receiptsDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		absReceiptPath, _ := filepath.Abs(receiptPath)
+		for _, dirEntry := range entries {
+			if dirEntry.IsDir() || filepath.Ext(dirEntry.Name()) != ".json" {
+				continue
+			}
+			otherPath := filepath.Join(receiptsDir, dirEntry.Name())
+			if absOtherPath, _ := filepath.Abs(otherPath); absOtherPath == absReceiptPath {
+				continue
+			}
+			other, err := manifest.LoadReceipt(otherPath)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			others = append(others, other)
 		}
 	}
 
-	// create the tarfile specified in outputFlag
-	if err := WriteTar(*outputFlag, allPaths); err != nil {
+	removed, err := manifest.Uninstall(receipt, others, root)
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	if *debugFlag {
-		fmt.Printf("[main]: packing complete!\n")
+	if debug {
+		for _, p := range removed {
+			fmt.Printf("[uninstall]: removed %s\n", p)
+		}
 	}
+	fmt.Printf("[uninstall]: removed %d of %d packed paths\n", len(removed), len(receipt.Paths))
 }
@@ -0,0 +1,282 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// media types for the two image formats micropacker can emit. The OCI and
+// Docker manifest/config schemas are wire-compatible enough that the same
+// imageConfig and descriptor plumbing can produce either, only the
+// mediaType strings (and the top-level index) differ.
+const (
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar"
+
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerConfig   = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayer    = "application/vnd.docker.image.rootfs.diff.tar"
+
+	ociImageLayoutVersion = "1.0.0"
+)
+
+// imageConfig carries the pieces of an image config blob that micropacker
+// can derive from the packed rootfs and its CLI flags. It intentionally
+// only covers the fields mentioned in the request: interp, entrypoint,
+// env, working dir, architecture and os.
+type imageConfig struct {
+	interp       string
+	entrypoint   string
+	env          []string
+	workingDir   string
+	architecture string
+	os           string
+}
+
+// ociDescriptor is a content-addressable pointer to a blob, shared by the
+// OCI and Docker manifest formats.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// ociImageConfig is the subset of the OCI image config spec micropacker
+// fills in; fields it cannot derive are simply omitted.
+type ociImageConfig struct {
+	Architecture string           `json:"architecture"`
+	OS           string           `json:"os"`
+	Config       ociConfigSection `json:"config"`
+	RootFS       ociRootFS        `json:"rootfs"`
+}
+
+type ociConfigSection struct {
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+type ociRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// ociManifest is the OCI/Docker image manifest: one config blob plus an
+// ordered list of layer blobs.
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// ociIndex is the top-level "index.json" of an OCI image layout.
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociLayout is the "oci-layout" marker file required alongside index.json.
+type ociLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// dockerManifestEntry is one entry of the legacy "manifest.json" read by
+// `docker load`.
+type dockerManifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags,omitempty"`
+	Layers   []string `json:"Layers"`
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeBlob writes data to blobsDir/<digest> (blobsDir being the
+// layout's blobs/sha256 directory) and returns a descriptor for it.
+func writeBlob(blobsDir string, mediaType string, data []byte) (ociDescriptor, error) {
+	digest := sha256Hex(data)
+	if err := os.WriteFile(filepath.Join(blobsDir, digest), data, 0644); err != nil {
+		return ociDescriptor{}, err
+	}
+	return ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + digest,
+		Size:      int64(len(data)),
+	}, nil
+}
+
+// WriteImage packs paths into a single rootfs layer and wraps it with an
+// image config and manifest, producing either an OCI image layout
+// ("oci") or a legacy `docker load`-compatible archive ("docker") at
+// outputPath. Both formats are themselves plain tar files, so the result
+// can be loaded with `docker load -i` or copied with
+// `skopeo copy oci-archive:...`.
+func WriteImage(outputPath string, paths []string, format string, compression string, opts tarOptions, cache *packCache, synthetic []syntheticEntry, cfg imageConfig) error {
+	stagingDir, err := os.MkdirTemp("", "micropacker-image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	blobsDir := filepath.Join(stagingDir, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return err
+	}
+
+	// write the rootfs layer first: its digest is only known once the
+	// stream has been fully written, so it is staged under a temporary
+	// name and moved into place once the layerWriter hands back the
+	// digest it computed while streaming.
+	layerTmpPath := filepath.Join(stagingDir, "layer.tar.tmp")
+	layerOpts := opts
+	layerOpts.layerRelative = true
+	layerWriter, err := newLayerWriter(layerTmpPath, compression, layerOpts, cache)
+	if err != nil {
+		return err
+	}
+	if err := layerWriter.addSynthetic(synthetic); err != nil {
+		layerWriter.file.Close()
+		return err
+	}
+	if err := layerWriter.addPaths(paths); err != nil {
+		layerWriter.file.Close()
+		return err
+	}
+	diffID, storedDigest, storedSize, err := layerWriter.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(layerTmpPath, filepath.Join(blobsDir, storedDigest)); err != nil {
+		return err
+	}
+
+	layerMediaType := mediaTypeOCILayer
+	configMediaType := mediaTypeOCIConfig
+	manifestMediaType := mediaTypeOCIManifest
+	if format == "docker" {
+		layerMediaType = mediaTypeDockerLayer
+		configMediaType = mediaTypeDockerConfig
+		manifestMediaType = mediaTypeDockerManifest
+	}
+	switch compression {
+	case "gzip":
+		layerMediaType += "+gzip"
+	case "zstd":
+		layerMediaType += "+zstd"
+	}
+	layerDescriptor := ociDescriptor{
+		MediaType: layerMediaType,
+		Digest:    "sha256:" + storedDigest,
+		Size:      storedSize,
+	}
+
+	// config blob
+	entrypoint := cfg.entrypoint
+	if entrypoint == "" {
+		entrypoint = filepath.Base(cfg.interp)
+	}
+	configBytes, err := json.Marshal(ociImageConfig{
+		Architecture: cfg.architecture,
+		OS:           cfg.os,
+		Config: ociConfigSection{
+			Env:        cfg.env,
+			Entrypoint: []string{entrypoint},
+			WorkingDir: cfg.workingDir,
+		},
+		RootFS: ociRootFS{
+			Type:    "layers",
+			DiffIDs: []string{"sha256:" + diffID},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	configDescriptor, err := writeBlob(blobsDir, configMediaType, configBytes)
+	if err != nil {
+		return err
+	}
+
+	// manifest blob
+	manifestBytes, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     manifestMediaType,
+		Config:        configDescriptor,
+		Layers:        []ociDescriptor{layerDescriptor},
+	})
+	if err != nil {
+		return err
+	}
+	manifestDescriptor, err := writeBlob(blobsDir, manifestMediaType, manifestBytes)
+	if err != nil {
+		return err
+	}
+
+	if format == "docker" {
+		if err := writeDockerTopLevel(stagingDir, blobsDir, configDescriptor, layerDescriptor); err != nil {
+			return err
+		}
+	} else {
+		if err := writeOCITopLevel(stagingDir, manifestDescriptor); err != nil {
+			return err
+		}
+	}
+
+	return tarDirectory(outputPath, stagingDir, opts)
+}
+
+// writeOCITopLevel writes index.json and the oci-layout marker expected
+// at the root of an OCI image layout.
+func writeOCITopLevel(stagingDir string, manifestDescriptor ociDescriptor) error {
+	indexBytes, err := json.Marshal(ociIndex{
+		SchemaVersion: 2,
+		Manifests:     []ociDescriptor{manifestDescriptor},
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(stagingDir, "index.json"), indexBytes, 0644); err != nil {
+		return err
+	}
+	layoutBytes, err := json.Marshal(ociLayout{ImageLayoutVersion: ociImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stagingDir, "oci-layout"), layoutBytes, 0644)
+}
+
+// writeDockerTopLevel writes the "manifest.json" file `docker load`
+// expects, pointing at the config/layer blobs by their blobs/sha256
+// path so the archive stays a single flat tar. There is no legacy
+// "repositories" file: micropacker has no concept of a repo name/tag to
+// put in one, and every `docker load` version since 1.10 reads
+// manifest.json instead.
+func writeDockerTopLevel(stagingDir, blobsDir string, configDescriptor, layerDescriptor ociDescriptor) error {
+	configPath, err := filepath.Rel(stagingDir, filepath.Join(blobsDir, configDescriptor.Digest[len("sha256:"):]))
+	if err != nil {
+		return err
+	}
+	layerPath, err := filepath.Rel(stagingDir, filepath.Join(blobsDir, layerDescriptor.Digest[len("sha256:"):]))
+	if err != nil {
+		return err
+	}
+	manifestBytes, err := json.Marshal([]dockerManifestEntry{{
+		Config: configPath,
+		Layers: []string{layerPath},
+	}})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stagingDir, "manifest.json"), manifestBytes, 0644)
+}
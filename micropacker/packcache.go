@@ -0,0 +1,186 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/vmware-archive/micropacker-for-containers/cache/contenthash"
+)
+
+// packCache lets repeated micropacker runs over a mostly-unchanged tree
+// (a JDK, a Python env, ...) skip re-reading files that haven't changed:
+// it persists a contenthash.Tree plus a content-addressable blob store
+// under dir between invocations. On a re-run, a regular file whose size
+// and mtime still match its previous record is streamed straight out of
+// the blob store instead of being opened and read again.
+type packCache struct {
+	dir      string
+	previous *contenthash.Tree
+	next     *contenthash.Tree
+}
+
+// openPackCache loads the Tree previously persisted under dir, if any.
+func openPackCache(dir string) (*packCache, error) {
+	previous, err := contenthash.Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &packCache{dir: dir, previous: previous, next: contenthash.New()}, nil
+}
+
+// save computes Merkle digests for every directory recorded this run
+// and persists the resulting tree to disk, so the next run (or a CI job
+// comparing two packs) can use it.
+func (c *packCache) save() error {
+	c.finalizeMerkleDigests()
+	return contenthash.Save(c.next, c.dir)
+}
+
+// recordNonRegular indexes a directory or symlink: both are cheap to
+// describe with just a header digest, no file content to hash.
+func (c *packCache) recordNonRegular(fullPath string, fileInfo os.FileInfo, tarHeader *tar.Header) {
+	headerDigest := contenthash.HashHeaderAttrs(tarHeader.Mode, tarHeader.Uid, tarHeader.Gid, tarHeader.Linkname, tarHeader.PAXRecords)
+	if fileInfo.IsDir() {
+		// the directory's own (no-trailing-slash) record holds the
+		// recursive Merkle digest, filled in later by
+		// finalizeMerkleDigests once all of its children are known;
+		// "path/" holds just this directory's own header digest.
+		c.next = c.next.Insert(fullPath+"/", contenthash.Record{IsDir: true, HeaderDigest: headerDigest})
+		c.next = c.next.Insert(fullPath, contenthash.Record{IsDir: true, HeaderDigest: headerDigest})
+		return
+	}
+	c.next = c.next.Insert(fullPath, contenthash.Record{HeaderDigest: headerDigest})
+}
+
+// streamRegularFile writes fullPath's content to w (normally the tar
+// writer for the current layer). If cache is non-nil and fullPath's
+// (size, modTime) is unchanged since the last run, the bytes are
+// streamed from the cache's blob store instead of being read from
+// fullPath again; otherwise they are read once, hashed, written to w and
+// to the cache in the same pass.
+func streamRegularFile(w io.Writer, fullPath string, fileInfo os.FileInfo, tarHeader *tar.Header, cache *packCache) error {
+	headerDigest := contenthash.HashHeaderAttrs(tarHeader.Mode, tarHeader.Uid, tarHeader.Gid, tarHeader.Linkname, tarHeader.PAXRecords)
+
+	if cache != nil {
+		if prev, ok := cache.previous.Get(fullPath); ok && !prev.IsDir &&
+			prev.Size == fileInfo.Size() && prev.ModTime.Equal(fileInfo.ModTime()) {
+			if blob, err := contenthash.OpenBlob(cache.dir, prev.ContentDigest); err == nil {
+				defer blob.Close()
+				if _, err := io.Copy(w, blob); err != nil {
+					return err
+				}
+				cache.next = cache.next.Insert(fullPath, contenthash.Record{
+					Size: prev.Size, ModTime: prev.ModTime,
+					ContentDigest: prev.ContentDigest, HeaderDigest: headerDigest,
+				})
+				return nil
+			}
+			// record says unchanged but the blob is gone (cache dir
+			// was partially cleared); fall through and re-read it
+		}
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if cache == nil {
+		_, err := io.CopyN(w, file, fileInfo.Size())
+		return err
+	}
+
+	blobTmp, err := contenthash.CreateTempBlob(cache.dir)
+	if err != nil {
+		// caching is best-effort; still produce a correct archive
+		_, err := io.CopyN(w, file, fileInfo.Size())
+		return err
+	}
+	hasher := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(w, hasher, blobTmp), file, fileInfo.Size()); err != nil {
+		blobTmp.Close()
+		os.Remove(blobTmp.Name())
+		return err
+	}
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	if err := blobTmp.Close(); err != nil {
+		return err
+	}
+	if err := contenthash.CommitBlob(cache.dir, blobTmp.Name(), digest); err != nil {
+		return err
+	}
+	cache.next = cache.next.Insert(fullPath, contenthash.Record{
+		Size: fileInfo.Size(), ModTime: fileInfo.ModTime(),
+		ContentDigest: digest, HeaderDigest: headerDigest,
+	})
+	return nil
+}
+
+// finalizeMerkleDigests fills in the recursive, order-independent Merkle
+// digest for every directory record in c.next, processing the deepest
+// paths first so each directory's children already have their final
+// digest by the time its own is computed.
+func (c *packCache) finalizeMerkleDigests() {
+	type item struct {
+		path   string
+		record contenthash.Record
+	}
+	var items []item
+	c.next.Walk(func(path string, record contenthash.Record) bool {
+		if !strings.HasSuffix(path, "/") {
+			items = append(items, item{path: path, record: record})
+		}
+		return false
+	})
+	sort.Slice(items, func(i, j int) bool {
+		return strings.Count(items[i].path, "/") > strings.Count(items[j].path, "/")
+	})
+
+	childDigests := map[string][]string{}
+	digestOf := func(it item) string {
+		if it.record.IsDir {
+			return it.record.MerkleDigest
+		}
+		if it.record.ContentDigest != "" {
+			return it.record.HeaderDigest + ":" + it.record.ContentDigest
+		}
+		return it.record.HeaderDigest
+	}
+	for _, it := range items {
+		if it.record.IsDir {
+			it.record.MerkleDigest = it.record.HeaderDigest
+			if children := childDigests[it.path]; len(children) > 0 {
+				it.record.MerkleDigest = contenthash.MerkleDigest(children)
+			}
+			c.next = c.next.Insert(it.path, it.record)
+		}
+		parent := parentDir(it.path)
+		if parent != "" {
+			childDigests[parent] = append(childDigests[parent], digestOf(it))
+		}
+	}
+}
+
+// parentDir returns the parent directory of an absolute, cleaned path,
+// or "" if path is already the root.
+func parentDir(path string) string {
+	if path == "/" {
+		return ""
+	}
+	idx := strings.LastIndexByte(path, '/')
+	if idx <= 0 {
+		return "/"
+	}
+	return path[:idx]
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vmware-archive/micropacker-for-containers/pkgmgr"
+)
+
+// gatherPackageInfo detects every pkgmgr.Backend present in the target
+// container (via container.lookEnvForFile) and queries them concurrently
+// for the owning package of every file in container.fileSet, writing the
+// result to outputPath as either human-readable text or JSON.
+func gatherPackageInfo(container baseContainer, outputPath string, format string, debugMode bool) error {
+	var detected []pkgmgr.Backend
+	for _, backend := range pkgmgr.Backends() {
+		if backend.Detect(container.lookEnvForFile) {
+			if debugMode {
+				fmt.Printf("[gatherPackageInfo]: %s package manager detected\n", backend.Name())
+			}
+			detected = append(detected, backend)
+		}
+	}
+	if len(detected) == 0 && debugMode {
+		fmt.Printf("[gatherPackageInfo]: warning! couldn't detect any known package manager\n")
+	}
+
+	files := make([]string, 0, len(container.fileSet))
+	for filePath := range container.fileSet {
+		files = append(files, filePath)
+	}
+	sort.Strings(files)
+
+	// each backend already batches every file into one (or two, for
+	// dpkg's separate version lookup) invocation, so the only
+	// parallelism left on the table is across backends themselves -
+	// run them concurrently via a worker per detected backend.
+	ownersPerBackend := make([]map[string]string, len(detected))
+	var wg sync.WaitGroup
+	for i, backend := range detected {
+		wg.Add(1)
+		go func(i int, backend pkgmgr.Backend) {
+			defer wg.Done()
+			owners, err := backend.QueryOwners(files)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			ownersPerBackend[i] = owners
+		}(i, backend)
+	}
+	wg.Wait()
+
+	var results []pkgmgr.Owner
+	for i, backend := range detected {
+		filePaths := make([]string, 0, len(ownersPerBackend[i]))
+		for filePath := range ownersPerBackend[i] {
+			filePaths = append(filePaths, filePath)
+		}
+		sort.Strings(filePaths)
+		for _, filePath := range filePaths {
+			name, version := splitOwnerDescriptor(ownersPerBackend[i][filePath])
+			results = append(results, pkgmgr.Owner{
+				File:    filePath,
+				Manager: backend.Name(),
+				Package: name,
+				Version: version,
+			})
+		}
+	}
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	if format == "json" {
+		encoder := json.NewEncoder(outFile)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+	return writePackageInfoText(outFile, detected, results)
+}
+
+// writePackageInfoText writes the "<manager> package manager
+// results:\n<pkg>: <file>\n...\n" text layout, grouped by manager in
+// Backends() order, for users not using -pf json. When a backend
+// resolved a version, a line reads "<pkg>@<version>: <file>" instead.
+func writePackageInfoText(outFile *os.File, detected []pkgmgr.Backend, results []pkgmgr.Owner) error {
+	for _, backend := range detected {
+		if _, err := fmt.Fprintf(outFile, "%s package manager results:\n", backend.Name()); err != nil {
+			return err
+		}
+		for _, owner := range results {
+			if owner.Manager != backend.Name() {
+				continue
+			}
+			if owner.Version == "" {
+				fmt.Fprintf(outFile, "%s: %s\n", owner.Package, owner.File)
+			} else {
+				fmt.Fprintf(outFile, "%s@%s: %s\n", owner.Package, owner.Version, owner.File)
+			}
+		}
+		fmt.Fprintln(outFile)
+	}
+	return nil
+}
+
+// splitOwnerDescriptor splits the "name@version" (or bare "name")
+// descriptor a Backend.QueryOwners result value carries.
+func splitOwnerDescriptor(descriptor string) (name, version string) {
+	if name, version, found := strings.Cut(descriptor, "@"); found {
+		return name, version
+	}
+	return descriptor, ""
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+package pkgmgr
+
+import "strings"
+
+// apkBackend queries Alpine's apk.
+type apkBackend struct {
+	binPath string
+}
+
+func (b *apkBackend) Name() string { return "apk" }
+
+func (b *apkBackend) Detect(lookEnv func(string) (string, bool)) bool {
+	binPath, ok := lookEnv("apk")
+	if !ok {
+		return false
+	}
+	b.binPath = binPath
+	return true
+}
+
+func (b *apkBackend) QueryOwners(files []string) (map[string]string, error) {
+	if len(files) == 0 {
+		return map[string]string{}, nil
+	}
+
+	// "apk info --who-owns f1 f2 f3" resolves every argument in one
+	// process, printing "<file> is owned by <pkg>-<version>" for a hit
+	// and leaving misses off stdout entirely (they go to stderr, which
+	// is discarded here), so there's nothing to re-zip against files.
+	output, err := execCmd(b.binPath, append([]string{"info", "--who-owns"}, files...)...)
+	if err != nil && output == "" {
+		return nil, err
+	}
+
+	owners := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		filePath, rest, found := strings.Cut(line, " is owned by ")
+		if !found {
+			continue
+		}
+		name, version := splitNameVersion(strings.TrimSpace(rest))
+		if version == "" {
+			owners[filePath] = name
+		} else {
+			owners[filePath] = name + "@" + version
+		}
+	}
+	return owners, nil
+}
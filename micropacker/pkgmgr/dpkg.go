@@ -0,0 +1,97 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+package pkgmgr
+
+import (
+	"sort"
+	"strings"
+)
+
+// dpkgBackend queries Debian/Ubuntu's dpkg-query, which can both look up
+// file owners (-S) and package versions (-W -f) for many arguments in a
+// single invocation.
+type dpkgBackend struct {
+	binPath string
+}
+
+func (b *dpkgBackend) Name() string { return "dpkg" }
+
+func (b *dpkgBackend) Detect(lookEnv func(string) (string, bool)) bool {
+	binPath, ok := lookEnv("dpkg-query")
+	if !ok {
+		return false
+	}
+	b.binPath = binPath
+	return true
+}
+
+func (b *dpkgBackend) QueryOwners(files []string) (map[string]string, error) {
+	if len(files) == 0 {
+		return map[string]string{}, nil
+	}
+
+	// "dpkg-query -S f1 f2 f3" prints one "package: file" line per
+	// match, skipping files owned by nothing, in a single process.
+	output, err := execCmd(b.binPath, append([]string{"-S"}, files...)...)
+	if err != nil && output == "" {
+		return nil, err
+	}
+
+	owners := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		pkgField, filePath, found := strings.Cut(line, ": ")
+		if !found {
+			continue
+		}
+		// a file can be listed by more than one package ("diverted by"
+		// entries, or two packages sharing a path); keep the first.
+		pkgName := strings.TrimSpace(strings.Split(pkgField, ",")[0])
+		owners[filePath] = pkgName
+	}
+	if len(owners) == 0 {
+		return owners, nil
+	}
+
+	versions := b.queryVersions(owners)
+	for filePath, pkgName := range owners {
+		if version, ok := versions[pkgName]; ok {
+			owners[filePath] = pkgName + "@" + version
+		}
+	}
+	return owners, nil
+}
+
+// queryVersions batches a single "dpkg-query -W -f ... pkg1 pkg2 ..."
+// call for every distinct package name QueryOwners resolved.
+func (b *dpkgBackend) queryVersions(owners map[string]string) map[string]string {
+	pkgSet := make(map[string]bool)
+	for _, pkgName := range owners {
+		pkgSet[pkgName] = true
+	}
+	pkgNames := make([]string, 0, len(pkgSet))
+	for pkgName := range pkgSet {
+		pkgNames = append(pkgNames, pkgName)
+	}
+	sort.Strings(pkgNames)
+
+	// ${binary:Package} includes the ":arch" multiarch qualifier dpkg -S
+	// puts on the package names it resolves, so the map keys line up.
+	args := append([]string{"-W", "-f=${binary:Package} ${Version}\n"}, pkgNames...)
+	output, err := execCmd(b.binPath, args...)
+	if err != nil && output == "" {
+		return nil
+	}
+
+	versions := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		versions[fields[0]] = fields[1]
+	}
+	return versions
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+package pkgmgr
+
+import "strings"
+
+// pacmanBackend queries Arch Linux's pacman.
+type pacmanBackend struct {
+	binPath string
+}
+
+func (b *pacmanBackend) Name() string { return "pacman" }
+
+func (b *pacmanBackend) Detect(lookEnv func(string) (string, bool)) bool {
+	binPath, ok := lookEnv("pacman")
+	if !ok {
+		return false
+	}
+	b.binPath = binPath
+	return true
+}
+
+func (b *pacmanBackend) QueryOwners(files []string) (map[string]string, error) {
+	if len(files) == 0 {
+		return map[string]string{}, nil
+	}
+
+	// "pacman -Qo f1 f2 f3" queries every argument in one process,
+	// printing "<file> is owned by <pkg> <version>" for a hit; a miss
+	// goes to stderr instead, so owners is built by matching on the
+	// file path text rather than relying on output order.
+	output, err := execCmd(b.binPath, append([]string{"-Qo"}, files...)...)
+	if err != nil && output == "" {
+		return nil, err
+	}
+
+	owners := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		filePath, rest, found := strings.Cut(line, " is owned by ")
+		if !found {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) != 2 {
+			continue
+		}
+		owners[filePath] = fields[0] + "@" + fields[1]
+	}
+	return owners, nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+// Package pkgmgr resolves which installed package owns each file
+// micropacker is about to pack, across whichever package manager(s) a
+// container actually has. Each manager is a Backend that batches many
+// paths into a single invocation instead of one exec per file.
+package pkgmgr
+
+import (
+	"bytes"
+	"os/exec"
+)
+
+// Owner is one resolved (file, package) pair, shaped for both the
+// human-readable text output and the machine-readable JSON output.
+type Owner struct {
+	File    string `json:"file"`
+	Manager string `json:"manager"`
+	Package string `json:"package"`
+	Version string `json:"version,omitempty"`
+}
+
+// Backend is a single package manager micropacker knows how to query.
+// Detect resolves the manager's binary on the target container's PATH
+// (via lookEnv, the same lookup baseContainer.lookEnvForFile performs)
+// and remembers it for QueryOwners; Detect must be called, and return
+// true, before QueryOwners is.
+type Backend interface {
+	Name() string
+	Detect(lookEnv func(string) (string, bool)) bool
+	QueryOwners(files []string) (map[string]string, error)
+}
+
+// Backends returns every known Backend implementation, in a fixed order
+// so -p output is deterministic regardless of which managers a given
+// container has installed.
+func Backends() []Backend {
+	return []Backend{
+		&dpkgBackend{},
+		&rpmBackend{},
+		&apkBackend{},
+		&pacmanBackend{},
+		&portageBackend{},
+	}
+}
+
+// execCmd runs executable with args and returns its stdout. Stdout is
+// still returned alongside a non-nil error, since some of these tools
+// (dpkg -S, rpm -qf) exit non-zero while still printing the lines they
+// did resolve.
+func execCmd(executable string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = &out
+	err := cmd.Run()
+	return out.String(), err
+}
+
+// splitNameVersion splits a "name-version" token on the last hyphen
+// immediately followed by a digit, the convention apk, pacman and
+// portage package atoms all follow (e.g. "busybox-1.36.1-r2" ->
+// "busybox", "1.36.1-r2"). If no such hyphen is found, the whole token
+// is returned as the name with an empty version.
+func splitNameVersion(nameVersion string) (name, version string) {
+	for i := len(nameVersion) - 1; i > 0; i-- {
+		if nameVersion[i-1] == '-' && nameVersion[i] >= '0' && nameVersion[i] <= '9' {
+			return nameVersion[:i-1], nameVersion[i:]
+		}
+	}
+	return nameVersion, ""
+}
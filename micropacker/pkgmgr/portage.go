@@ -0,0 +1,63 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+package pkgmgr
+
+import "strings"
+
+// portageBackend queries Gentoo's portage via qfile, from app-portage/gentoolkit.
+type portageBackend struct {
+	binPath string
+}
+
+func (b *portageBackend) Name() string { return "portage" }
+
+func (b *portageBackend) Detect(lookEnv func(string) (string, bool)) bool {
+	binPath, ok := lookEnv("qfile")
+	if !ok {
+		return false
+	}
+	b.binPath = binPath
+	return true
+}
+
+func (b *portageBackend) QueryOwners(files []string) (map[string]string, error) {
+	if len(files) == 0 {
+		return map[string]string{}, nil
+	}
+
+	// "qfile f1 f2 f3" prints one "<cat/pkg-version> (<f1>, <f2>, ...)"
+	// line per owning package in a single process, grouping together
+	// every queried file that package owns.
+	output, err := execCmd(b.binPath, files...)
+	if err != nil && output == "" {
+		return nil, err
+	}
+
+	owners := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		atom, fileList, found := strings.Cut(line, " (")
+		if !found || !strings.HasSuffix(fileList, ")") {
+			continue
+		}
+		fileList = strings.TrimSuffix(fileList, ")")
+
+		slashIdx := strings.IndexByte(atom, '/')
+		nameVersion := atom
+		if slashIdx >= 0 {
+			nameVersion = atom[slashIdx+1:]
+		}
+		name, version := splitNameVersion(nameVersion)
+		descriptor := name
+		if version != "" {
+			descriptor = name + "@" + version
+		}
+
+		for _, filePath := range strings.Split(fileList, ", ") {
+			owners[strings.TrimSpace(filePath)] = descriptor
+		}
+	}
+	return owners, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2019 VMware, Inc.
+SPDX-License-Identifier: BSD-2-Clause
+*/
+
+package pkgmgr
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// rpmBackend queries rpm, which resolves name *and* version for many
+// files in one invocation via --queryformat, unlike dpkg which needs a
+// second batched call for versions.
+type rpmBackend struct {
+	binPath string
+}
+
+func (b *rpmBackend) Name() string { return "rpm" }
+
+func (b *rpmBackend) Detect(lookEnv func(string) (string, bool)) bool {
+	binPath, ok := lookEnv("rpm")
+	if !ok {
+		return false
+	}
+	b.binPath = binPath
+	return true
+}
+
+func (b *rpmBackend) QueryOwners(files []string) (map[string]string, error) {
+	if len(files) == 0 {
+		return map[string]string{}, nil
+	}
+
+	// "rpm -qf f1 f2 f3" queries each argument independently in a single
+	// process, but a file it can't resolve prints nothing to stdout -
+	// only a "file ... is not owned by any package" line to stderr -
+	// instead of a stdout placeholder, so stdout alone can't be zipped
+	// back against files positionally as soon as any file misses.
+	// Interleaving stdout and stderr into the same file descriptor
+	// keeps one line per queried file, in argument order, letting a
+	// miss be told apart from a hit without losing that mapping.
+	combined, err := os.CreateTemp("", "micropacker-rpm-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(combined.Name())
+	defer combined.Close()
+
+	args := append([]string{"-qf", "--queryformat", "%{NAME}@%{VERSION}-%{RELEASE}\n"}, files...)
+	cmd := exec.Command(b.binPath, args...)
+	cmd.Stdout = combined
+	cmd.Stderr = combined
+	_ = cmd.Run() // a mix of hits and misses is the common case, not an error
+
+	if _, err := combined.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	output, err := io.ReadAll(combined)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[string]string)
+	lines := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+	if len(lines) != len(files) {
+		// still desynchronized (e.g. rpm itself failed to start);
+		// bail out rather than risk attributing a file to the wrong
+		// package
+		return owners, nil
+	}
+	for i, line := range lines {
+		if !strings.Contains(line, "@") {
+			continue // rpm's own "is not owned by any package" message
+		}
+		owners[files[i]] = line
+	}
+	return owners, nil
+}
@@ -7,14 +7,21 @@ package main
 
 import (
 	"archive/tar"
-	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
 	"debug/elf"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 func GetInterpFromExec(file string) (string, error) {
@@ -40,6 +47,34 @@ func GetInterpFromExec(file string) (string, error) {
 	return "", err
 }
 
+// elfMachineToOCIArch maps the subset of debug/elf.Machine values
+// micropacker is likely to encounter to the architecture names used by
+// the OCI image config ("architecture" field).
+var elfMachineToOCIArch = map[elf.Machine]string{
+	elf.EM_X86_64:  "amd64",
+	elf.EM_386:     "386",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_ARM:     "arm",
+	elf.EM_PPC64:   "ppc64le",
+	elf.EM_S390:    "s390x",
+}
+
+// GetArchFromExec reads the ELF machine type of file and returns the
+// matching OCI image config architecture string, falling back to
+// runtime.GOARCH if file isn't an ELF binary or its machine type is
+// unrecognized.
+func GetArchFromExec(file string) string {
+	elfFile, err := elf.Open(file)
+	if err != nil {
+		return runtime.GOARCH
+	}
+	defer elfFile.Close()
+	if arch, ok := elfMachineToOCIArch[elfFile.Machine]; ok {
+		return arch
+	}
+	return runtime.GOARCH
+}
+
 func IsDir(filename string) (bool, error) {
 	var err error
 	var fileInfo os.FileInfo
@@ -78,23 +113,258 @@ func IsFolderNeeded(folder string, fileSet map[string]bool, folderSet map[string
 	return true
 }
 
-func WriteTar(tarPath string, paths []string) error {
-	tarFile, err := os.Create(tarPath)
+// layerWriter streams tar entries for a set of filesystem paths straight
+// to disk while computing two running sha256 digests: uncompressed (the
+// OCI "diff_id", taken over the plain tar bytes) and stored (the digest
+// of whatever actually lands on disk, i.e. after compression, used as
+// the blob's own digest and name). This lets a caller learn both
+// digests without a second pass over the data once writing is done.
+type layerWriter struct {
+	file             *os.File
+	uncompressedHash hash.Hash
+	storedHash       hash.Hash
+	storedSize       int64
+	compressor       io.WriteCloser
+	tar              *tar.Writer
+	opts             tarOptions
+	cache            *packCache
+}
+
+// tarOptions controls the reproducibility knobs applied to every tar
+// header addToTar writes, so that packing the same input twice produces
+// a byte-identical stream: a pinned timestamp (SOURCE_DATE_EPOCH-style),
+// and normalized ownership.
+type tarOptions struct {
+	uid             int
+	gid             int
+	sourceDateEpoch int64
+
+	// layerRelative strips the leading "/" from entry names, as the OCI
+	// image layer spec requires: layer tar entries are relative to the
+	// rootfs, not absolute host paths. Legacy -f tar raw mode leaves this
+	// false so its entries stay absolute, matching how it has always
+	// extracted.
+	layerRelative bool
+}
+
+// reproducibleTime is the timestamp opts pins every tar header to.
+func (opts tarOptions) reproducibleTime() time.Time {
+	return time.Unix(opts.sourceDateEpoch, 0).UTC()
+}
+
+func newLayerWriter(destPath string, compression string, opts tarOptions, cache *packCache) (*layerWriter, error) {
+	file, err := os.Create(destPath)
+	if err != nil {
+		return nil, err
+	}
+	lw := &layerWriter{file: file, uncompressedHash: sha256.New(), storedHash: sha256.New(), opts: opts, cache: cache}
+	storedWriter := io.MultiWriter(file, lw.storedHash, sizeCounter{&lw.storedSize})
+	compressor, err := newCompressor(storedWriter, compression)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	lw.compressor = compressor
+	lw.tar = tar.NewWriter(io.MultiWriter(compressor, lw.uncompressedHash))
+	return lw, nil
+}
+
+// nopWriteCloser adapts an io.Writer with no meaningful Close (e.g. "no
+// compression") to io.WriteCloser so newLayerWriter can treat every
+// compression mode the same way.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newCompressor wraps w so everything written to the returned
+// WriteCloser ends up, compressed as requested, in w. Closing it flushes
+// and finalizes the compressed stream but does not close w itself.
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "", "none":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown compression %q, expected gzip, zstd or none", compression)
+	}
+}
+
+// sizeCounter is an io.Writer that only tallies how many bytes pass
+// through it, used alongside the file and hash writers in a MultiWriter.
+type sizeCounter struct {
+	total *int64
+}
+
+func (c sizeCounter) Write(p []byte) (int, error) {
+	*c.total += int64(len(p))
+	return len(p), nil
+}
+
+func (lw *layerWriter) addPaths(paths []string) error {
+	for _, path := range paths {
+		if err := addToTar(lw.tar, path, lw.opts, lw.cache); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syntheticEntry is a tar entry whose content comes from the manifest
+// rather than the packing host's filesystem: an explicit symlink, or a
+// pre/post-install hook script.
+type syntheticEntry struct {
+	name     string
+	linkname string // set for symlinks; mutually exclusive with content
+	content  []byte // set for regular files
+	mode     int64
+}
+
+// addSynthetic writes entries straight to the tar stream without
+// touching the filesystem.
+func (lw *layerWriter) addSynthetic(entries []syntheticEntry) error {
+	reproducibleTime := lw.opts.reproducibleTime()
+	for _, entry := range entries {
+		name := entry.name
+		if lw.opts.layerRelative {
+			name = strings.TrimPrefix(name, "/")
+		}
+		tarHeader := &tar.Header{
+			Name:       name,
+			Mode:       entry.mode,
+			Uid:        lw.opts.uid,
+			Gid:        lw.opts.gid,
+			ModTime:    reproducibleTime,
+			AccessTime: reproducibleTime,
+			ChangeTime: reproducibleTime,
+			Format:     tar.FormatPAX,
+		}
+		if entry.linkname != "" {
+			tarHeader.Typeflag = tar.TypeSymlink
+			tarHeader.Linkname = entry.linkname
+		} else {
+			tarHeader.Typeflag = tar.TypeReg
+			tarHeader.Size = int64(len(entry.content))
+		}
+		if err := lw.tar.WriteHeader(tarHeader); err != nil {
+			return err
+		}
+		if tarHeader.Typeflag == tar.TypeReg {
+			if _, err := lw.tar.Write(entry.content); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close flushes the tar and compression streams, closes the underlying
+// file, and returns the hex-encoded sha256 digest of the uncompressed
+// tar stream (diffID), plus the digest and size of the bytes actually
+// written to disk (storedDigest/storedSize).
+func (lw *layerWriter) Close() (diffID string, storedDigest string, storedSize int64, err error) {
+	if err := lw.tar.Close(); err != nil {
+		lw.compressor.Close()
+		lw.file.Close()
+		return "", "", 0, err
+	}
+	if err := lw.compressor.Close(); err != nil {
+		lw.file.Close()
+		return "", "", 0, err
+	}
+	if err := lw.file.Close(); err != nil {
+		return "", "", 0, err
+	}
+	return hex.EncodeToString(lw.uncompressedHash.Sum(nil)),
+		hex.EncodeToString(lw.storedHash.Sum(nil)),
+		lw.storedSize, nil
+}
+
+// WriteTar writes a tar of paths to tarPath, optionally compressed. This
+// is micropacker's original output mode (a raw rootfs tar); it is now a
+// thin wrapper around the same layerWriter used by the OCI/Docker image
+// output modes.
+func WriteTar(tarPath string, paths []string, compression string, opts tarOptions, cache *packCache, synthetic []syntheticEntry) error {
+	lw, err := newLayerWriter(tarPath, compression, opts, cache)
+	if err != nil {
+		return err
+	}
+	if err := lw.addSynthetic(synthetic); err != nil {
+		lw.file.Close()
+		return err
+	}
+	if err := lw.addPaths(paths); err != nil {
+		lw.file.Close()
+		return err
+	}
+	_, _, _, err = lw.Close()
+	return err
+}
+
+// tarDirectory writes every file under srcDir into a plain tar archive at
+// destPath, preserving srcDir-relative paths. It is used to turn a
+// staged OCI/Docker image layout into the single tar file that
+// `docker load` and `skopeo copy oci-archive:...` expect. opts is
+// applied the same way addToTar applies it to the inner layer tar, so
+// the staging directory's own entries (blobs, index.json, manifest.json,
+// oci-layout) don't reintroduce non-reproducible mtimes/uid/gid into an
+// otherwise pinned, reproducible pack.
+func tarDirectory(destPath, srcDir string, opts tarOptions) error {
+	tarFile, err := os.Create(destPath)
 	if err != nil {
 		return err
 	}
 	defer tarFile.Close()
 	tarWriter := tar.NewWriter(tarFile)
 	defer tarWriter.Close()
-	for _, path := range paths {
-		if err := addToTar(tarWriter, path); err != nil {
+
+	reproducibleTime := opts.reproducibleTime()
+	return filepath.Walk(srcDir, func(fullPath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
 			return err
 		}
-	}
-	return nil
+		if fullPath == srcDir {
+			return nil
+		}
+		relPath, err := filepath.Rel(srcDir, fullPath)
+		if err != nil {
+			return err
+		}
+		tarHeader, err := tar.FileInfoHeader(fileInfo, "")
+		if err != nil {
+			return err
+		}
+		tarHeader.Name = relPath
+		tarHeader.ModTime = reproducibleTime
+		tarHeader.AccessTime = reproducibleTime
+		tarHeader.ChangeTime = reproducibleTime
+		tarHeader.Uname = ""
+		tarHeader.Gname = ""
+		tarHeader.Uid = opts.uid
+		tarHeader.Gid = opts.gid
+		tarHeader.Format = tar.FormatPAX
+		if err := tarWriter.WriteHeader(tarHeader); err != nil {
+			return err
+		}
+		if fileInfo.Mode().IsRegular() {
+			file, err := os.Open(fullPath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if _, err := io.CopyN(tarWriter, file, fileInfo.Size()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-func addToTar(tarWriter *tar.Writer, path string) error {
+func addToTar(tarWriter *tar.Writer, path string, opts tarOptions, cache *packCache) error {
 	return filepath.Walk(path, func(fullPath string, fileInfo os.FileInfo, err error) error {
 		// filepath.Walk failed
 		if err != nil {
@@ -115,29 +385,35 @@ func addToTar(tarWriter *tar.Writer, path string) error {
 		}
 		// put the fullpath back in tarHeader.Name
 		tarHeader.Name = fullPath
+		if opts.layerRelative {
+			tarHeader.Name = strings.TrimPrefix(tarHeader.Name, "/")
+		}
+
+		// normalize everything that would otherwise make the same
+		// input produce a different archive on every run, so two
+		// packs of an unchanged tree are byte-identical
+		reproducibleTime := opts.reproducibleTime()
+		tarHeader.ModTime = reproducibleTime
+		tarHeader.AccessTime = reproducibleTime
+		tarHeader.ChangeTime = reproducibleTime
+		tarHeader.Uname = ""
+		tarHeader.Gname = ""
+		tarHeader.Uid = opts.uid
+		tarHeader.Gid = opts.gid
+		tarHeader.Format = tar.FormatPAX
+
 		err = tarWriter.WriteHeader(tarHeader)
 		if err != nil {
 			return err
 		}
 		if tarHeader.Typeflag == tar.TypeReg {
-			file, err := os.Open(fullPath)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			_, err = io.CopyN(tarWriter, file, fileInfo.Size())
-			if err != nil {
+			if err := streamRegularFile(tarWriter, fullPath, fileInfo, tarHeader, cache); err != nil {
 				return err
 			}
+		} else if cache != nil {
+			cache.recordNonRegular(fullPath, fileInfo, tarHeader)
 		}
 		return nil
 	})
 }
 
-func ExecCmd(executable string, executableArgs ...string) (string, error) {
-	var out bytes.Buffer
-	cmd := exec.Command(executable, executableArgs...)
-	cmd.Stdout = &out
-        err := cmd.Run()
-	return out.String(), err
-}